@@ -0,0 +1,262 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Client is a dynamically-registered OAuth2 client (RFC 7591).
+// ClientSecret and RegistrationAccessToken are stored hashed, like access
+// and refresh tokens.
+type Client struct {
+	ClientId                string   `json:"client_id"`
+	ClientSecret            string   `json:"client_secret"`
+	RegistrationAccessToken string   `json:"registration_access_token"`
+	RedirectUris            []string `json:"redirect_uris"`
+	TokenEndpointAuthMethod string   `json:"token_endpoint_auth_method"`
+	GrantTypes              []string `json:"grant_types"`
+	ResponseTypes           []string `json:"response_types"`
+	ClientName              string   `json:"client_name,omitempty"`
+}
+
+// ClientMetadata is the subset of RFC 7591 client metadata obligator
+// accepts on registration and update; it's also what GET/PUT /register/{id}
+// exchange.
+type ClientMetadata struct {
+	RedirectUris            []string `json:"redirect_uris"`
+	TokenEndpointAuthMethod string   `json:"token_endpoint_auth_method,omitempty"`
+	GrantTypes              []string `json:"grant_types,omitempty"`
+	ResponseTypes           []string `json:"response_types,omitempty"`
+	ClientName              string   `json:"client_name,omitempty"`
+}
+
+// ClientRegistrationResponse is ClientMetadata plus the RFC 7591/7592
+// registration fields.
+type ClientRegistrationResponse struct {
+	ClientMetadata
+	ClientId                string `json:"client_id"`
+	ClientSecret            string `json:"client_secret,omitempty"`
+	RegistrationAccessToken string `json:"registration_access_token,omitempty"`
+	RegistrationClientUri   string `json:"registration_client_uri"`
+}
+
+func applyClientMetadataDefaults(m *ClientMetadata) {
+	if m.TokenEndpointAuthMethod == "" {
+		m.TokenEndpointAuthMethod = "client_secret_basic"
+	}
+	if len(m.GrantTypes) == 0 {
+		m.GrantTypes = []string{"authorization_code"}
+	}
+	if len(m.ResponseTypes) == 0 {
+		m.ResponseTypes = []string{"code"}
+	}
+}
+
+// handleRegisterClient implements RFC 7591 POST /register.
+func handleRegisterClient(w http.ResponseWriter, r *http.Request, storage *FileStorage, rootUri string) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(405)
+		io.WriteString(w, "Invalid method")
+		return
+	}
+
+	metadata := ClientMetadata{}
+	err := json.NewDecoder(r.Body).Decode(&metadata)
+	if err != nil {
+		w.WriteHeader(400)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	if len(metadata.RedirectUris) == 0 {
+		w.WriteHeader(400)
+		io.WriteString(w, "redirect_uris is required")
+		return
+	}
+
+	applyClientMetadataDefaults(&metadata)
+
+	clientId, err := GenerateRandomToken(16)
+	if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	var clientSecret string
+	if metadata.TokenEndpointAuthMethod != "none" {
+		clientSecret, err = GenerateRandomToken(32)
+		if err != nil {
+			w.WriteHeader(500)
+			io.WriteString(w, err.Error())
+			return
+		}
+	}
+
+	registrationAccessToken, err := GenerateRandomToken(32)
+	if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	client := &Client{
+		ClientId:                clientId,
+		ClientSecret:            Hash(clientSecret),
+		RegistrationAccessToken: Hash(registrationAccessToken),
+		RedirectUris:            metadata.RedirectUris,
+		TokenEndpointAuthMethod: metadata.TokenEndpointAuthMethod,
+		GrantTypes:              metadata.GrantTypes,
+		ResponseTypes:           metadata.ResponseTypes,
+		ClientName:              metadata.ClientName,
+	}
+
+	err = storage.AddClient(client)
+	if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	w.WriteHeader(201)
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(ClientRegistrationResponse{
+		ClientMetadata:          metadata,
+		ClientId:                clientId,
+		ClientSecret:            clientSecret,
+		RegistrationAccessToken: registrationAccessToken,
+		RegistrationClientUri:   fmt.Sprintf("%s/register/%s", rootUri, clientId),
+	})
+}
+
+// handleClientConfig implements RFC 7592 GET/PUT/DELETE /register/{client_id},
+// protected by the registration_access_token minted at registration time.
+func handleClientConfig(w http.ResponseWriter, r *http.Request, storage *FileStorage, rootUri string) {
+	clientId := strings.TrimPrefix(r.URL.Path, "/register/")
+	if clientId == "" {
+		w.WriteHeader(404)
+		return
+	}
+
+	client, err := storage.GetClient(clientId)
+	if err != nil {
+		w.WriteHeader(404)
+		io.WriteString(w, "Unknown client")
+		return
+	}
+
+	presentedToken := bearerToken(r)
+	if presentedToken == "" || subtle.ConstantTimeCompare([]byte(Hash(presentedToken)), []byte(client.RegistrationAccessToken)) != 1 {
+		w.WriteHeader(401)
+		io.WriteString(w, "Invalid registration_access_token")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeClientConfig(w, client, rootUri)
+
+	case http.MethodPut:
+		metadata := ClientMetadata{}
+		err := json.NewDecoder(r.Body).Decode(&metadata)
+		if err != nil {
+			w.WriteHeader(400)
+			io.WriteString(w, err.Error())
+			return
+		}
+		if len(metadata.RedirectUris) == 0 {
+			w.WriteHeader(400)
+			io.WriteString(w, "redirect_uris is required")
+			return
+		}
+		applyClientMetadataDefaults(&metadata)
+
+		client.RedirectUris = metadata.RedirectUris
+		client.TokenEndpointAuthMethod = metadata.TokenEndpointAuthMethod
+		client.GrantTypes = metadata.GrantTypes
+		client.ResponseTypes = metadata.ResponseTypes
+		client.ClientName = metadata.ClientName
+
+		err = storage.UpdateClient(clientId, client)
+		if err != nil {
+			w.WriteHeader(500)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		writeClientConfig(w, client, rootUri)
+
+	case http.MethodDelete:
+		err := storage.DeleteClient(clientId)
+		if err != nil {
+			w.WriteHeader(500)
+			io.WriteString(w, err.Error())
+			return
+		}
+		w.WriteHeader(204)
+
+	default:
+		w.WriteHeader(405)
+	}
+}
+
+func writeClientConfig(w http.ResponseWriter, client *Client, rootUri string) {
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(ClientRegistrationResponse{
+		ClientMetadata: ClientMetadata{
+			RedirectUris:            client.RedirectUris,
+			TokenEndpointAuthMethod: client.TokenEndpointAuthMethod,
+			GrantTypes:              client.GrantTypes,
+			ResponseTypes:           client.ResponseTypes,
+			ClientName:              client.ClientName,
+		},
+		ClientId:              client.ClientId,
+		RegistrationClientUri: fmt.Sprintf("%s/register/%s", rootUri, client.ClientId),
+	})
+}
+
+func bearerToken(r *http.Request) string {
+	parts := strings.SplitN(r.Header.Get("Authorization"), " ", 2)
+	if len(parts) != 2 || parts[0] != "Bearer" {
+		return ""
+	}
+	return parts[1]
+}
+
+// authenticateClient enforces client_secret verification for confidential
+// clients at the /token endpoint, accepting either HTTP Basic auth or a
+// client_secret_post form field. Clients that were never dynamically
+// registered fall back to the legacy trust-the-redirect_uri model.
+func authenticateClient(r *http.Request, storage *FileStorage, clientId string) bool {
+	client, err := storage.GetClient(clientId)
+	if err != nil {
+		return true
+	}
+
+	if client.TokenEndpointAuthMethod == "none" {
+		return true
+	}
+
+	var presentedSecret string
+	if basicClientId, basicSecret, ok := r.BasicAuth(); ok && basicClientId == clientId {
+		presentedSecret = basicSecret
+	} else {
+		presentedSecret = r.Form.Get("client_secret")
+	}
+
+	if presentedSecret == "" {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(Hash(presentedSecret)), []byte(client.ClientSecret)) == 1
+}
@@ -0,0 +1,89 @@
+package cookie
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func testSecret() []byte {
+	return []byte("0123456789abcdef0123456789abcdef")[:32]
+}
+
+func TestSignedValueRoundTrip(t *testing.T) {
+	secret := testSecret()
+	now := time.Now()
+
+	value, err := SignedValue(secret, "my_cookie", "hello world", now)
+	if err != nil {
+		t.Fatalf("SignedValue: %v", err)
+	}
+
+	payload, ok := Validate("my_cookie", value, secret, time.Hour)
+	if !ok {
+		t.Fatal("Validate rejected a freshly signed value")
+	}
+	if payload != "hello world" {
+		t.Errorf("payload = %q, want %q", payload, "hello world")
+	}
+}
+
+func TestValidateRejectsTamperedValue(t *testing.T) {
+	secret := testSecret()
+	now := time.Now()
+
+	value, err := SignedValue(secret, "my_cookie", "hello world", now)
+	if err != nil {
+		t.Fatalf("SignedValue: %v", err)
+	}
+
+	parts := strings.Split(value, "|")
+	parts[0] = parts[0] + "x"
+	tampered := strings.Join(parts, "|")
+
+	if _, ok := Validate("my_cookie", tampered, secret, time.Hour); ok {
+		t.Error("Validate accepted a tampered ciphertext")
+	}
+}
+
+func TestValidateRejectsWrongName(t *testing.T) {
+	secret := testSecret()
+	now := time.Now()
+
+	value, err := SignedValue(secret, "my_cookie", "hello world", now)
+	if err != nil {
+		t.Fatalf("SignedValue: %v", err)
+	}
+
+	if _, ok := Validate("other_cookie", value, secret, time.Hour); ok {
+		t.Error("Validate accepted a value replayed under a different cookie name")
+	}
+}
+
+func TestValidateRejectsExpiredValue(t *testing.T) {
+	secret := testSecret()
+	now := time.Now()
+
+	value, err := SignedValue(secret, "my_cookie", "hello world", now)
+	if err != nil {
+		t.Fatalf("SignedValue: %v", err)
+	}
+
+	if _, ok := Validate("my_cookie", value, secret, time.Nanosecond); ok {
+		t.Error("Validate accepted a value past its expiration")
+	}
+}
+
+func TestValidateExpirationZeroDisablesAgeCheck(t *testing.T) {
+	secret := testSecret()
+	now := time.Now().Add(-24 * time.Hour)
+
+	value, err := SignedValue(secret, "my_cookie", "hello world", now)
+	if err != nil {
+		t.Fatalf("SignedValue: %v", err)
+	}
+
+	if _, ok := Validate("my_cookie", value, secret, 0); !ok {
+		t.Error("Validate rejected an old value despite expiration=0")
+	}
+}
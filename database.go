@@ -76,3 +76,38 @@ func (s *Database) GetEmailValidationCounts(since time.Time) ([]*EmailValidation
 
 	return counts, nil
 }
+
+type EmailValidationCountByEmail struct {
+	HashedEmail string
+	Count       int
+}
+
+// GetEmailValidationCountsByEmail mirrors GetEmailValidationCounts, but
+// groups by the hashed email address instead of the hashed requester id, so
+// callers can rate-limit per-email in addition to per-requester.
+func (s *Database) GetEmailValidationCountsByEmail(since time.Time) ([]*EmailValidationCountByEmail, error) {
+
+	timeFmt := since.Format(time.DateTime)
+	rows, err := s.db.Query("SELECT hashed_email,count(*) FROM email_validation_requests WHERE timestamp > ? GROUP BY hashed_email", timeFmt)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := []*EmailValidationCountByEmail{}
+
+	for rows.Next() {
+		var count EmailValidationCountByEmail
+		err = rows.Scan(&count.HashedEmail, &count.Count)
+		if err != nil {
+			return nil, err
+		}
+		counts = append(counts, &count)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return counts, nil
+}
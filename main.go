@@ -3,7 +3,10 @@ package main
 import (
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
 	"embed"
+	"encoding/base64"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -20,8 +23,19 @@ import (
 	"github.com/lestrrat-go/jwx/jwk"
 	"github.com/lestrrat-go/jwx/jwt"
 	"github.com/lestrrat-go/jwx/jwt/openid"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/lastlogin-net/obligator/providers"
 )
 
+// EmailRateLimitConfig bounds how many /email-code requests a single IP or
+// email address may make per hour, configurable via FileStorage so
+// deployments can tune it without a code change.
+type EmailRateLimitConfig struct {
+	PerIpPerHour    int `json:"per_ip_per_hour"`
+	PerEmailPerHour int `json:"per_email_per_hour"`
+}
+
 type SmtpConfig struct {
 	Server     string `json:"server,omitempty"`
 	Username   string `json:"username,omitempty"`
@@ -32,31 +46,49 @@ type SmtpConfig struct {
 }
 
 type OIDCDiscoveryDoc struct {
-	Issuer                string `json:"issuer"`
-	AuthorizationEndpoint string `json:"authorization_endpoint"`
-	TokenEndpoint         string `json:"token_endpoint"`
-	UserinfoEndpoint      string `json:"userinfo_endpoint"`
-	JwksUri               string `json:"jwks_uri"`
+	Issuer                        string   `json:"issuer"`
+	AuthorizationEndpoint         string   `json:"authorization_endpoint"`
+	TokenEndpoint                 string   `json:"token_endpoint"`
+	UserinfoEndpoint              string   `json:"userinfo_endpoint"`
+	JwksUri                       string   `json:"jwks_uri"`
+	RegistrationEndpoint          string   `json:"registration_endpoint"`
+	CodeChallengeMethodsSupported []string `json:"code_challenge_methods_supported"`
 }
 
 type OAuth2AuthRequest struct {
-	LoginKey         string `json:"login_key"`
-	RawQuery         string `json:"raw_query"`
-	ClientId         string `json:"client_id"`
-	RedirectUri      string `json:"redirect_uri"`
-	State            string `json:"state"`
-	Scope            string `json:"scope"`
-	Provider         string `json:"provider"`
-	Nonce            string `json:"nonce"`
-	ProviderNonce    string `json:"provider_nonce"`
-	PKCECodeVerifier string `json:"pkce_code_verifier"`
+	LoginKey            string `json:"login_key"`
+	RawQuery            string `json:"raw_query"`
+	ClientId            string `json:"client_id"`
+	RedirectUri         string `json:"redirect_uri"`
+	State               string `json:"state"`
+	Scope               string `json:"scope"`
+	Provider            string `json:"provider"`
+	Nonce               string `json:"nonce"`
+	ProviderNonce       string `json:"provider_nonce"`
+	PKCECodeVerifier    string `json:"pkce_code_verifier"`
+	CodeChallenge       string `json:"code_challenge"`
+	CodeChallengeMethod string `json:"code_challenge_method"`
 }
 
 type Oauth2TokenResponse struct {
-	AccessToken string `json:"access_token"`
-	TokenType   string `json:"token_type"`
-	ExpiresIn   int    `json:"expires_in"`
-	IdToken     string `json:"id_token"`
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	IdToken      string `json:"id_token"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+}
+
+// Oauth2ErrorResponse is the RFC 6749 section 5.2 error body returned from
+// the /token endpoint.
+type Oauth2ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+func writeOauth2Error(w http.ResponseWriter, statusCode int, errorCode string) {
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(Oauth2ErrorResponse{Error: errorCode})
 }
 
 type OathgateMux struct {
@@ -124,8 +156,46 @@ func main() {
 		storage.AddJWKKey(key)
 	}
 
+	cookieSecret := storage.GetCookieSecret()
+	if len(cookieSecret) != 32 {
+		cookieSecret = make([]byte, 32)
+		_, err := rand.Read(cookieSecret)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+
+		err = storage.SetCookieSecret(cookieSecret)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+	}
+
 	emailAuth := NewEmailAuth(storage)
 
+	providerRegistry, err := providers.NewRegistry(storage.GetProviderConfigs())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+
+	rootUriHost, err := url.Parse(storage.GetRootUri())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+
+	webAuthn, err := webauthn.New(&webauthn.Config{
+		RPDisplayName: "obligator",
+		RPID:          rootUriHost.Hostname(),
+		RPOrigins:     []string{storage.GetRootUri()},
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+
 	publicJwks, err := jwk.PublicSetOf(storage.GetJWKSet())
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err.Error())
@@ -151,11 +221,13 @@ func main() {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 
 		doc := OIDCDiscoveryDoc{
-			Issuer:                rootUri,
-			AuthorizationEndpoint: fmt.Sprintf("%s/auth", rootUri),
-			TokenEndpoint:         fmt.Sprintf("%s/token", rootUri),
-			UserinfoEndpoint:      fmt.Sprintf("%s/userinfo", rootUri),
-			JwksUri:               fmt.Sprintf("%s/jwks", rootUri),
+			Issuer:                        rootUri,
+			AuthorizationEndpoint:         fmt.Sprintf("%s/auth", rootUri),
+			TokenEndpoint:                 fmt.Sprintf("%s/token", rootUri),
+			UserinfoEndpoint:              fmt.Sprintf("%s/userinfo", rootUri),
+			JwksUri:                       fmt.Sprintf("%s/jwks", rootUri),
+			RegistrationEndpoint:          fmt.Sprintf("%s/register", rootUri),
+			CodeChallengeMethodsSupported: []string{"S256", "plain"},
 		}
 
 		json.NewEncoder(w).Encode(doc)
@@ -246,7 +318,13 @@ func main() {
 			return
 		}
 
-		if !strings.HasPrefix(redirectUri, clientId) {
+		if registeredClient, err := storage.GetClient(clientId); err == nil {
+			if !stringSliceContains(registeredClient.RedirectUris, redirectUri) {
+				w.WriteHeader(400)
+				io.WriteString(w, "redirect_uri does not match any registered redirect_uris")
+				return
+			}
+		} else if !strings.HasPrefix(redirectUri, clientId) {
 			w.WriteHeader(400)
 			io.WriteString(w, "redirect_uri must be on the same domain as client_id")
 			return
@@ -254,6 +332,19 @@ func main() {
 
 		state := r.Form.Get("state")
 
+		codeChallenge := r.Form.Get("code_challenge")
+		codeChallengeMethod := r.Form.Get("code_challenge_method")
+		if codeChallenge != "" {
+			if codeChallengeMethod == "" {
+				codeChallengeMethod = "plain"
+			}
+			if codeChallengeMethod != "S256" && codeChallengeMethod != "plain" {
+				w.WriteHeader(400)
+				io.WriteString(w, "unsupported code_challenge_method")
+				return
+			}
+		}
+
 		promptParam := r.Form.Get("prompt")
 		if promptParam == "none" {
 			errUrl := fmt.Sprintf("%s?error=interaction_required&state=%s",
@@ -274,20 +365,24 @@ func main() {
 
 		var loginKey string
 
-		loginKeyCookie, err := r.Cookie("login_key")
-		if err == nil {
+		if state, ok := readSessionCookie(r, storage, cookieSecret); ok {
+			loginKey = state.LoginKey
+			identities = identitiesFromIds(storage, state.IdentityIds)
+		} else if loginKeyCookie, err := r.Cookie("login_key"); err == nil {
 			loginKey = Hash(loginKeyCookie.Value)
 			identities = storage.GetIdentitiesByLoginKey(loginKey)
 		}
 
 		req := OAuth2AuthRequest{
-			LoginKey:    loginKey,
-			RawQuery:    r.URL.RawQuery,
-			ClientId:    clientId,
-			RedirectUri: redirectUri,
-			State:       state,
-			Scope:       r.Form.Get("scope"),
-			Nonce:       r.Form.Get("nonce"),
+			LoginKey:            loginKey,
+			RawQuery:            r.URL.RawQuery,
+			ClientId:            clientId,
+			RedirectUri:         redirectUri,
+			State:               state,
+			Scope:               r.Form.Get("scope"),
+			Nonce:               r.Form.Get("nonce"),
+			CodeChallenge:       codeChallenge,
+			CodeChallengeMethod: codeChallengeMethod,
 		}
 
 		requestId, err := storage.AddRequest(req)
@@ -373,6 +468,12 @@ func main() {
 			return
 		}
 
+		if requiresWebAuthn(storage, identId) && !hasRecentWebAuthnVerification(loginKey, identId) {
+			w.WriteHeader(401)
+			io.WriteString(w, "This identity requires a second-factor passkey verification before it can be approved. Complete /webauthn/verify/begin and /webauthn/verify/finish first.")
+			return
+		}
+
 		issuedAt := time.Now().UTC()
 		expiresAt := issuedAt.Add(10 * time.Minute)
 
@@ -393,7 +494,9 @@ func main() {
 		}
 
 		oauth2Token := &PendingOAuth2Token{
-			IdToken: token,
+			IdToken:             token,
+			CodeChallenge:       request.CodeChallenge,
+			CodeChallengeMethod: request.CodeChallengeMethod,
 		}
 
 		code, err := storage.AddPendingToken(oauth2Token)
@@ -418,6 +521,13 @@ func main() {
 
 		r.ParseForm()
 
+		grantType := r.Form.Get("grant_type")
+
+		if grantType == "refresh_token" {
+			handleRefreshTokenGrant(w, r, storage, rootUri)
+			return
+		}
+
 		code := r.Form.Get("code")
 
 		token, err := storage.GetPendingToken(code)
@@ -438,6 +548,19 @@ func main() {
 			return
 		}
 
+		if token.CodeChallenge != "" {
+			codeVerifier := r.Form.Get("code_verifier")
+			if codeVerifier == "" || !verifyPKCE(token.CodeChallenge, token.CodeChallengeMethod, codeVerifier) {
+				writeOauth2Error(w, 400, "invalid_grant")
+				return
+			}
+		}
+
+		if !authenticateClient(r, storage, token.IdToken.Audience()[0]) {
+			writeOauth2Error(w, 401, "invalid_client")
+			return
+		}
+
 		storage.DeletePendingToken(code)
 
 		tokenData := &Token{
@@ -468,14 +591,22 @@ func main() {
 			return
 		}
 
+		refreshToken, err := issueRefreshToken(storage, token.IdToken.Subject(), token.IdToken.Audience()[0], "", "")
+		if err != nil {
+			w.WriteHeader(500)
+			fmt.Fprintf(os.Stderr, err.Error())
+			return
+		}
+
 		w.Header().Set("Content-Type", "application/json;charset=UTF-8")
 		w.Header().Set("Cache-Control", "no-store")
 
 		tokenRes := Oauth2TokenResponse{
-			AccessToken: token.AccessToken,
-			ExpiresIn:   3600,
-			IdToken:     string(signed),
-			TokenType:   "bearer",
+			AccessToken:  token.AccessToken,
+			ExpiresIn:    3600,
+			IdToken:      string(signed),
+			TokenType:    "bearer",
+			RefreshToken: refreshToken,
 		}
 
 		enc := json.NewEncoder(w)
@@ -524,6 +655,33 @@ func main() {
 			return
 		}
 
+		remoteIp, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			w.WriteHeader(500)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		limited, retryAfter, err := checkEmailCodeRateLimit(storage, remoteIp, email)
+		if err != nil {
+			w.WriteHeader(500)
+			io.WriteString(w, err.Error())
+			return
+		}
+		if limited {
+			w.Header().Set("Retry-After", fmt.Sprintf("%d", retryAfter))
+			w.WriteHeader(429)
+			io.WriteString(w, "Too many email code requests. Please try again later.")
+			return
+		}
+
+		err = storage.AddEmailValidationRequest(remoteIp, email)
+		if err != nil {
+			w.WriteHeader(500)
+			io.WriteString(w, err.Error())
+			return
+		}
+
 		requestId := r.Form.Get("request_id")
 
 		emailRequestId, err := emailAuth.StartEmailValidation(email)
@@ -587,39 +745,11 @@ func main() {
 			return
 		}
 
-		var loginKey string
-		loggedIn := false
-
-		loginKeyCookie, err := r.Cookie("login_key")
-		if err == nil {
-			loginKey = Hash(loginKeyCookie.Value)
-			_, err := storage.GetLoginData(loginKey)
-			if err == nil {
-				loggedIn = true
-			}
-		}
-
-		if !loggedIn {
-			unhashedLoginKey, err := storage.AddLoginData()
-			if err != nil {
-				w.WriteHeader(500)
-				fmt.Fprintf(os.Stderr, err.Error())
-				return
-			}
-
-			cookie := &http.Cookie{
-				Name:     "login_key",
-				Value:    unhashedLoginKey,
-				Secure:   true,
-				HttpOnly: true,
-				MaxAge:   86400 * 365,
-				Path:     "/",
-				SameSite: http.SameSiteLaxMode,
-				//SameSite: http.SameSiteStrictMode,
-			}
-			http.SetCookie(w, cookie)
-
-			loginKey = Hash(unhashedLoginKey)
+		loginKey, err := ensureLoginKey(w, r, storage)
+		if err != nil {
+			w.WriteHeader(500)
+			fmt.Fprintf(os.Stderr, err.Error())
+			return
 		}
 
 		identId, err := storage.EnsureIdentity(email, "Email", email)
@@ -631,6 +761,13 @@ func main() {
 
 		storage.EnsureLoginMapping(identId, loginKey)
 
+		err = refreshSessionCookie(w, storage, cookieSecret, loginKey)
+		if err != nil {
+			w.WriteHeader(500)
+			fmt.Fprintf(os.Stderr, err.Error())
+			return
+		}
+
 		redirUrl := fmt.Sprintf("%s/auth?%s", rootUri, request.RawQuery)
 
 		http.Redirect(w, r, redirUrl, http.StatusSeeOther)
@@ -651,6 +788,8 @@ func main() {
 			storage.DeleteLoginData(loginKey)
 		}
 
+		clearSessionCookie(w)
+
 		redirect := r.Form.Get("prev_page")
 
 		cookie := &http.Cookie{
@@ -668,6 +807,147 @@ func main() {
 		http.Redirect(w, r, redirect, http.StatusSeeOther)
 	})
 
+	mux.HandleFunc("/login-oauth2/", func(w http.ResponseWriter, r *http.Request) {
+		providerName := strings.TrimPrefix(r.URL.Path, "/login-oauth2/")
+
+		provider, exists := providerRegistry[providerName]
+		if !exists {
+			w.WriteHeader(404)
+			io.WriteString(w, "Unknown provider")
+			return
+		}
+
+		r.ParseForm()
+
+		requestId := r.Form.Get("request_id")
+
+		request, err := storage.GetRequest(requestId)
+		if err != nil {
+			w.WriteHeader(500)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		codeVerifier, err := GeneratePKCECodeVerifier()
+		if err != nil {
+			w.WriteHeader(500)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		request.Provider = providerName
+		request.ProviderNonce = requestId
+		request.PKCECodeVerifier = codeVerifier
+
+		err = storage.UpdateRequest(requestId, request)
+		if err != nil {
+			w.WriteHeader(500)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		callbackUri := fmt.Sprintf("%s/callback/%s", rootUri, providerName)
+		loginUrl := provider.GetLoginURL(callbackUri, requestId, PKCECodeChallengeS256(codeVerifier))
+
+		http.Redirect(w, r, loginUrl, http.StatusSeeOther)
+	})
+
+	mux.HandleFunc("/callback/", func(w http.ResponseWriter, r *http.Request) {
+		providerName := strings.TrimPrefix(r.URL.Path, "/callback/")
+
+		provider, exists := providerRegistry[providerName]
+		if !exists {
+			w.WriteHeader(404)
+			io.WriteString(w, "Unknown provider")
+			return
+		}
+
+		r.ParseForm()
+
+		requestId := r.Form.Get("state")
+
+		request, err := storage.GetRequest(requestId)
+		if err != nil {
+			w.WriteHeader(500)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		if request.Provider != providerName || request.ProviderNonce != requestId {
+			w.WriteHeader(403)
+			io.WriteString(w, "state does not match outstanding login request")
+			return
+		}
+
+		callbackUri := fmt.Sprintf("%s/callback/%s", rootUri, providerName)
+
+		_, email, sub, err := provider.Redeem(r.Context(), callbackUri, r.Form.Get("code"), request.PKCECodeVerifier)
+		if err != nil {
+			w.WriteHeader(400)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		loginKey, err := ensureLoginKey(w, r, storage)
+		if err != nil {
+			w.WriteHeader(500)
+			fmt.Fprintf(os.Stderr, err.Error())
+			return
+		}
+
+		identId, err := storage.EnsureIdentity(email, providerName, sub)
+		if err != nil {
+			w.WriteHeader(500)
+			fmt.Fprintf(os.Stderr, err.Error())
+			return
+		}
+
+		storage.EnsureLoginMapping(identId, loginKey)
+
+		err = refreshSessionCookie(w, storage, cookieSecret, loginKey)
+		if err != nil {
+			w.WriteHeader(500)
+			fmt.Fprintf(os.Stderr, err.Error())
+			return
+		}
+
+		redirUrl := fmt.Sprintf("%s/auth?%s", rootUri, request.RawQuery)
+
+		http.Redirect(w, r, redirUrl, http.StatusSeeOther)
+	})
+
+	mux.HandleFunc("/webauthn/register/begin", func(w http.ResponseWriter, r *http.Request) {
+		handleWebAuthnRegisterBegin(w, r, storage, webAuthn)
+	})
+
+	mux.HandleFunc("/webauthn/register/finish", func(w http.ResponseWriter, r *http.Request) {
+		handleWebAuthnRegisterFinish(w, r, storage, webAuthn)
+	})
+
+	mux.HandleFunc("/webauthn/login/begin", func(w http.ResponseWriter, r *http.Request) {
+		handleWebAuthnLoginBegin(w, r, storage, webAuthn)
+	})
+
+	mux.HandleFunc("/webauthn/login/finish", func(w http.ResponseWriter, r *http.Request) {
+		handleWebAuthnLoginFinish(w, r, storage, webAuthn, rootUri, cookieSecret)
+	})
+
+	mux.HandleFunc("/webauthn/verify/begin", func(w http.ResponseWriter, r *http.Request) {
+		handleWebAuthnVerifyBegin(w, r, storage, webAuthn)
+	})
+
+	mux.HandleFunc("/webauthn/verify/finish", func(w http.ResponseWriter, r *http.Request) {
+		handleWebAuthnVerifyFinish(w, r, storage, webAuthn)
+	})
+
+	mux.HandleFunc("/register", func(w http.ResponseWriter, r *http.Request) {
+		handleRegisterClient(w, r, storage, rootUri)
+	})
+
+	mux.HandleFunc("/register/", func(w http.ResponseWriter, r *http.Request) {
+		handleClientConfig(w, r, storage, rootUri)
+	})
+
 	mux.HandleFunc("/debug", func(w http.ResponseWriter, r *http.Request) {
 		printJson(r.Header)
 	})
@@ -704,6 +984,148 @@ func main() {
 	}
 }
 
+const (
+	defaultEmailRateLimitPerIp    = 10
+	defaultEmailRateLimitPerEmail = 5
+)
+
+// checkEmailCodeRateLimit enforces a sliding one-hour window over the
+// sqlite-backed email_validation_requests log, bounding how many
+// /email-code requests a single IP or a single email address can trigger.
+// It returns whether the request should be rejected and, if so, how many
+// seconds the caller should wait before trying again.
+func checkEmailCodeRateLimit(storage *FileStorage, remoteIp, email string) (bool, int, error) {
+	limits := storage.GetEmailRateLimitConfig()
+
+	ipMax := limits.PerIpPerHour
+	if ipMax <= 0 {
+		ipMax = defaultEmailRateLimitPerIp
+	}
+
+	emailMax := limits.PerEmailPerHour
+	if emailMax <= 0 {
+		emailMax = defaultEmailRateLimitPerEmail
+	}
+
+	// email_validation_requests timestamps are sqlite CURRENT_TIMESTAMP,
+	// which is UTC, so the window start must be UTC too.
+	since := time.Now().UTC().Add(-1 * time.Hour)
+	const retryAfterSeconds = 3600
+
+	ipCounts, err := storage.GetEmailValidationCounts(since)
+	if err != nil {
+		return false, 0, err
+	}
+
+	hashedIp := Hash(remoteIp)
+	for _, c := range ipCounts {
+		if c.HashedRequesterId == hashedIp && c.Count >= ipMax {
+			return true, retryAfterSeconds, nil
+		}
+	}
+
+	emailCounts, err := storage.GetEmailValidationCountsByEmail(since)
+	if err != nil {
+		return false, 0, err
+	}
+
+	hashedEmail := Hash(email)
+	for _, c := range emailCounts {
+		if c.HashedEmail == hashedEmail && c.Count >= emailMax {
+			return true, retryAfterSeconds, nil
+		}
+	}
+
+	return false, 0, nil
+}
+
+// refreshSessionCookie re-issues the obligator_session cookie with the
+// caller's current list of linked identities, called whenever that list
+// changes (a new identity gets linked to loginKey).
+func refreshSessionCookie(w http.ResponseWriter, storage *FileStorage, cookieSecret []byte, loginKey string) error {
+	identities := storage.GetIdentitiesByLoginKey(loginKey)
+
+	identityIds := make([]string, len(identities))
+	for i, ident := range identities {
+		identityIds[i] = ident.Id
+	}
+
+	return setSessionCookie(w, storage, cookieSecret, loginKey, identityIds)
+}
+
+// ensureLoginKey returns the hashed login_key identifying the caller's
+// session, minting a fresh one and setting the login_key cookie if the
+// caller doesn't already have a valid session. Shared by every login method
+// (email-code, upstream federation) so they all end up in the same
+// identity-linking flow.
+func ensureLoginKey(w http.ResponseWriter, r *http.Request, storage *FileStorage) (string, error) {
+	loginKeyCookie, err := r.Cookie("login_key")
+	if err == nil {
+		loginKey := Hash(loginKeyCookie.Value)
+		_, err := storage.GetLoginData(loginKey)
+		if err == nil {
+			return loginKey, nil
+		}
+	}
+
+	unhashedLoginKey, err := storage.AddLoginData()
+	if err != nil {
+		return "", err
+	}
+
+	cookie := &http.Cookie{
+		Name:     "login_key",
+		Value:    unhashedLoginKey,
+		Secure:   true,
+		HttpOnly: true,
+		MaxAge:   86400 * 365,
+		Path:     "/",
+		SameSite: http.SameSiteLaxMode,
+	}
+	http.SetCookie(w, cookie)
+
+	return Hash(unhashedLoginKey), nil
+}
+
+// GeneratePKCECodeVerifier returns a random RFC 7636 code_verifier, used by
+// obligator itself when it acts as an OAuth2 client against an upstream
+// provider.
+func GeneratePKCECodeVerifier() (string, error) {
+	return GenerateRandomToken(32)
+}
+
+// PKCECodeChallengeS256 computes the S256 code_challenge for a given
+// code_verifier per RFC 7636 section 4.2.
+func PKCECodeChallengeS256(codeVerifier string) string {
+	sum := sha256.Sum256([]byte(codeVerifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func stringSliceContains(haystack []string, needle string) bool {
+	for _, s := range haystack {
+		if s == needle {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyPKCE checks a client-supplied code_verifier against the
+// code_challenge recorded at /auth time, per RFC 7636 section 4.6.
+func verifyPKCE(codeChallenge, codeChallengeMethod, codeVerifier string) bool {
+	var computed string
+	switch codeChallengeMethod {
+	case "S256":
+		computed = PKCECodeChallengeS256(codeVerifier)
+	case "plain":
+		computed = codeVerifier
+	default:
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(codeChallenge)) == 1
+}
+
 func GenerateJWK() (jwk.Key, error) {
 	raw, err := rsa.GenerateKey(rand.Reader, 2048)
 	if err != nil {
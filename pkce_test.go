@@ -0,0 +1,33 @@
+package main
+
+import "testing"
+
+func TestVerifyPKCES256(t *testing.T) {
+	verifier, err := GeneratePKCECodeVerifier()
+	if err != nil {
+		t.Fatalf("GeneratePKCECodeVerifier: %v", err)
+	}
+	challenge := PKCECodeChallengeS256(verifier)
+
+	if !verifyPKCE(challenge, "S256", verifier) {
+		t.Error("verifyPKCE rejected a correct S256 verifier")
+	}
+	if verifyPKCE(challenge, "S256", verifier+"x") {
+		t.Error("verifyPKCE accepted a wrong verifier")
+	}
+}
+
+func TestVerifyPKCEPlain(t *testing.T) {
+	if !verifyPKCE("abc", "plain", "abc") {
+		t.Error("verifyPKCE rejected a matching plain verifier")
+	}
+	if verifyPKCE("abc", "plain", "def") {
+		t.Error("verifyPKCE accepted a mismatched plain verifier")
+	}
+}
+
+func TestVerifyPKCEUnknownMethod(t *testing.T) {
+	if verifyPKCE("abc", "foo", "abc") {
+		t.Error("verifyPKCE accepted an unknown code_challenge_method")
+	}
+}
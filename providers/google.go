@@ -0,0 +1,12 @@
+package providers
+
+// newGoogleProvider builds an oidcProvider for Google's "Sign In with
+// Google" OIDC endpoints. Google needs no provider-specific overrides, so
+// the returned Provider is just a configured *oidcProvider.
+func newGoogleProvider(cfg Config) (Provider, error) {
+	if cfg.DiscoveryUri == "" {
+		cfg.DiscoveryUri = "https://accounts.google.com/.well-known/openid-configuration"
+	}
+
+	return newOidcProvider(cfg, "google", "openid email")
+}
@@ -0,0 +1,12 @@
+package providers
+
+// newLinkedinProvider builds an oidcProvider for LinkedIn's "Sign In with
+// LinkedIn using OpenID Connect" product, which is a standard OIDC
+// implementation needing no provider-specific overrides.
+func newLinkedinProvider(cfg Config) (Provider, error) {
+	if cfg.DiscoveryUri == "" {
+		cfg.DiscoveryUri = "https://www.linkedin.com/oauth/.well-known/openid-configuration"
+	}
+
+	return newOidcProvider(cfg, "linkedin", "openid email")
+}
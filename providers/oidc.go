@@ -0,0 +1,179 @@
+package providers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/lestrrat-go/jwx/jwt"
+	"github.com/lestrrat-go/jwx/jwt/openid"
+)
+
+// discoveryDoc is the subset of an OIDC discovery document obligator needs
+// in order to drive an upstream authorization-code flow.
+type discoveryDoc struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksUri               string `json:"jwks_uri"`
+}
+
+func fetchDiscoveryDoc(discoveryUri string) (*discoveryDoc, error) {
+	res, err := http.Get(discoveryUri)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	doc := &discoveryDoc{}
+	err = json.NewDecoder(res.Body).Decode(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	return doc, nil
+}
+
+// oidcProvider implements the common parts of Provider for any upstream
+// that exposes a standard OIDC discovery document and an authorization-code
+// token endpoint. The Google and LinkedIn providers are plain configured
+// oidcProviders; GitHub has no ID token, so githubProvider is a separate
+// implementation that does not use this type.
+type oidcProvider struct {
+	name         string
+	clientId     string
+	clientSecret string
+	doc          *discoveryDoc
+	scope        string
+}
+
+func newOidcProvider(cfg Config, name, scope string) (*oidcProvider, error) {
+	doc, err := fetchDiscoveryDoc(cfg.DiscoveryUri)
+	if err != nil {
+		return nil, fmt.Errorf("fetching %s discovery document: %w", name, err)
+	}
+
+	return &oidcProvider{
+		name:         name,
+		clientId:     cfg.ClientId,
+		clientSecret: cfg.ClientSecret,
+		doc:          doc,
+		scope:        scope,
+	}, nil
+}
+
+func (p *oidcProvider) Name() string {
+	return p.name
+}
+
+func (p *oidcProvider) GetLoginURL(redirectUri, state, codeChallenge string) string {
+	v := url.Values{}
+	v.Set("client_id", p.clientId)
+	v.Set("redirect_uri", redirectUri)
+	v.Set("response_type", "code")
+	v.Set("scope", p.scope)
+	v.Set("state", state)
+	if codeChallenge != "" {
+		v.Set("code_challenge", codeChallenge)
+		v.Set("code_challenge_method", "S256")
+	}
+
+	return fmt.Sprintf("%s?%s", p.doc.AuthorizationEndpoint, v.Encode())
+}
+
+func (p *oidcProvider) redeemCode(redirectUri, code, codeVerifier string) (string, error) {
+	v := url.Values{}
+	v.Set("client_id", p.clientId)
+	v.Set("client_secret", p.clientSecret)
+	v.Set("redirect_uri", redirectUri)
+	v.Set("grant_type", "authorization_code")
+	v.Set("code", code)
+	if codeVerifier != "" {
+		v.Set("code_verifier", codeVerifier)
+	}
+
+	res, err := http.PostForm(p.doc.TokenEndpoint, v)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	tokenRes := struct {
+		IdToken string `json:"id_token"`
+	}{}
+	err = json.NewDecoder(res.Body).Decode(&tokenRes)
+	if err != nil {
+		return "", err
+	}
+
+	if tokenRes.IdToken == "" {
+		return "", fmt.Errorf("%s token endpoint returned no id_token", p.name)
+	}
+
+	return tokenRes.IdToken, nil
+}
+
+// verifyIdToken fetches the upstream's current JWKS and verifies idToken's
+// signature, expiry, audience, issuer, and email_verified claim.
+func (p *oidcProvider) verifyIdToken(ctx context.Context, idToken string) (openid.Token, error) {
+	set, err := jwk.Fetch(ctx, p.doc.JwksUri)
+	if err != nil {
+		return nil, err
+	}
+
+	parsed, err := jwt.ParseString(
+		idToken,
+		jwt.WithKeySet(set),
+		jwt.WithToken(openid.New()),
+		jwt.WithValidate(true),
+		jwt.WithAudience(p.clientId),
+		jwt.WithIssuer(p.doc.Issuer),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	verified := parsed.(openid.Token)
+
+	if emailVerified, ok := verified.Get("email_verified"); ok {
+		if verifiedBool, ok := emailVerified.(bool); ok && !verifiedBool {
+			return nil, fmt.Errorf("%s asserted an unverified email address", p.name)
+		}
+	}
+
+	return verified, nil
+}
+
+func (p *oidcProvider) ValidateSessionState(ctx context.Context, idToken string) bool {
+	_, err := p.verifyIdToken(ctx, idToken)
+	return err == nil
+}
+
+// Redeem implements Provider.Redeem for any plain OIDC upstream whose ID
+// token already carries a verified email and a stable subject. GitHub has
+// no ID token, so githubProvider implements its own Redeem instead.
+func (p *oidcProvider) Redeem(ctx context.Context, redirectUri, code, codeVerifier string) (string, string, string, error) {
+	idToken, err := p.redeemCode(redirectUri, code, codeVerifier)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	verified, err := p.verifyIdToken(ctx, idToken)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	return idToken, verified.Email(), verified.Subject(), nil
+}
+
+func (p *oidcProvider) GetEmailAddress(ctx context.Context, idToken string) (string, error) {
+	verified, err := p.verifyIdToken(ctx, idToken)
+	if err != nil {
+		return "", err
+	}
+
+	return verified.Email(), nil
+}
@@ -0,0 +1,74 @@
+// Package providers implements upstream OIDC/OAuth2 identity provider
+// federation, allowing obligator to broker logins through third-party
+// services instead of (or in addition to) its own email-code flow.
+package providers
+
+import (
+	"context"
+	"fmt"
+)
+
+// Provider is implemented by each upstream identity provider obligator can
+// federate to.
+type Provider interface {
+	// Name returns the provider's short identifier, e.g. "google", used in
+	// the /login-oauth2/{provider} and /callback/{provider} routes.
+	Name() string
+
+	// GetLoginURL returns the upstream authorization endpoint URL the user
+	// should be redirected to in order to start a login.
+	GetLoginURL(redirectUri, state, codeChallenge string) string
+
+	// Redeem exchanges an authorization code for an ID token and returns
+	// the token along with the identity it asserts.
+	Redeem(ctx context.Context, redirectUri, code, codeVerifier string) (idToken, email, sub string, err error)
+
+	// GetEmailAddress extracts the verified email address from a redeemed
+	// ID token.
+	GetEmailAddress(ctx context.Context, idToken string) (string, error)
+
+	// ValidateSessionState checks that a previously-redeemed session is
+	// still valid upstream.
+	ValidateSessionState(ctx context.Context, idToken string) bool
+}
+
+// Config holds the obligator-side configuration for a single upstream
+// provider, as loaded from FileStorage.
+type Config struct {
+	Name         string `json:"name"`
+	ClientId     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	DiscoveryUri string `json:"discovery_uri"`
+}
+
+// New constructs the Provider implementation matching cfg.Name.
+func New(cfg Config) (Provider, error) {
+	switch cfg.Name {
+	case "google":
+		return newGoogleProvider(cfg)
+	case "github":
+		return newGithubProvider(cfg)
+	case "linkedin":
+		return newLinkedinProvider(cfg)
+	default:
+		return nil, fmt.Errorf("unknown upstream provider: %s", cfg.Name)
+	}
+}
+
+// Registry maps a provider name to its configured Provider.
+type Registry map[string]Provider
+
+// NewRegistry builds a Registry from a set of provider configs, skipping
+// none and failing loudly if any config is invalid, so misconfiguration is
+// caught at startup rather than at first login attempt.
+func NewRegistry(configs []Config) (Registry, error) {
+	reg := Registry{}
+	for _, cfg := range configs {
+		p, err := New(cfg)
+		if err != nil {
+			return nil, err
+		}
+		reg[p.Name()] = p
+	}
+	return reg, nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/lestrrat-go/jwx/jwa"
+	"github.com/lestrrat-go/jwx/jwt"
+	"github.com/lestrrat-go/jwx/jwt/openid"
+)
+
+const refreshTokenLifetime = 30 * 24 * time.Hour
+
+// RefreshToken is a single refresh token as stored server-side, keyed by
+// Hash(token) the same way access Tokens are keyed by Hash(accessToken).
+// Family groups every token issued from a single login: rotation mints a
+// new RefreshToken in the same Family and marks the previous one Used; a
+// Used token redeemed again means the family was stolen and replayed, so
+// the whole family gets revoked.
+type RefreshToken struct {
+	IdentityId string    `json:"identity_id"`
+	ClientId   string    `json:"client_id"`
+	Scope      string    `json:"scope"`
+	Family     string    `json:"family"`
+	CreatedAt  time.Time `json:"created_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	Used       bool      `json:"used"`
+}
+
+// GenerateRandomToken returns a random URL-safe token with nBytes of entropy.
+func GenerateRandomToken(nBytes int) (string, error) {
+	b := make([]byte, nBytes)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// issueRefreshToken mints and persists a new refresh token for identityId/
+// clientId/scope. Pass an existing family to rotate within it, or "" to
+// start a new one.
+func issueRefreshToken(storage *FileStorage, identityId, clientId, scope, family string) (string, error) {
+	if family == "" {
+		var err error
+		family, err = GenerateRandomToken(16)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	token, err := GenerateRandomToken(32)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now().UTC()
+
+	rt := &RefreshToken{
+		IdentityId: identityId,
+		ClientId:   clientId,
+		Scope:      scope,
+		Family:     family,
+		CreatedAt:  now,
+		ExpiresAt:  now.Add(refreshTokenLifetime),
+		Used:       false,
+	}
+
+	err = storage.AddRefreshToken(Hash(token), rt)
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// handleRefreshTokenGrant implements grant_type=refresh_token for /token.
+func handleRefreshTokenGrant(w http.ResponseWriter, r *http.Request, storage *FileStorage, rootUri string) {
+	presentedToken := r.Form.Get("refresh_token")
+	if presentedToken == "" {
+		writeOauth2Error(w, 400, "invalid_request")
+		return
+	}
+
+	hashedToken := Hash(presentedToken)
+
+	rt, err := storage.GetRefreshToken(hashedToken)
+	if err != nil {
+		writeOauth2Error(w, 400, "invalid_grant")
+		return
+	}
+
+	if !authenticateClient(r, storage, rt.ClientId) {
+		writeOauth2Error(w, 401, "invalid_client")
+		return
+	}
+
+	if rt.Used {
+		// A used refresh token was presented again. This only happens if a
+		// refresh token was stolen and replayed, so the whole family is
+		// presumed compromised and revoked.
+		storage.DeleteRefreshTokenFamily(rt.Family)
+		writeOauth2Error(w, 400, "invalid_grant")
+		return
+	}
+
+	if time.Now().UTC().After(rt.ExpiresAt) {
+		writeOauth2Error(w, 400, "invalid_grant")
+		return
+	}
+
+	err = storage.SetRefreshTokenUsed(hashedToken)
+	if err != nil {
+		writeOauth2Error(w, 500, "server_error")
+		return
+	}
+
+	identity, err := storage.GetIdentityById(rt.IdentityId)
+	if err != nil {
+		writeOauth2Error(w, 500, "server_error")
+		return
+	}
+
+	newRefreshToken, err := issueRefreshToken(storage, rt.IdentityId, rt.ClientId, rt.Scope, rt.Family)
+	if err != nil {
+		writeOauth2Error(w, 500, "server_error")
+		return
+	}
+
+	accessToken, err := GenerateRandomToken(32)
+	if err != nil {
+		writeOauth2Error(w, 500, "server_error")
+		return
+	}
+
+	issuedAt := time.Now().UTC()
+	expiresAt := issuedAt.Add(10 * time.Minute)
+
+	idToken, err := openid.NewBuilder().
+		Subject(rt.IdentityId).
+		Audience([]string{rt.ClientId}).
+		Issuer(rootUri).
+		Email(identity.Email).
+		EmailVerified(true).
+		IssuedAt(issuedAt).
+		Expiration(expiresAt).
+		Build()
+	if err != nil {
+		writeOauth2Error(w, 500, "server_error")
+		return
+	}
+
+	key, exists := storage.GetJWKSet().Get(0)
+	if !exists {
+		writeOauth2Error(w, 500, "server_error")
+		return
+	}
+
+	signed, err := jwt.Sign(idToken, jwa.RS256, key)
+	if err != nil {
+		writeOauth2Error(w, 500, "server_error")
+		return
+	}
+
+	tokenData := &Token{
+		IdentityId: rt.IdentityId,
+		CreatedAt:  issuedAt.Format(time.RFC3339),
+		ExpiresIn:  10,
+	}
+
+	err = storage.SetToken(Hash(accessToken), tokenData)
+	if err != nil {
+		writeOauth2Error(w, 500, "server_error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	w.Header().Set("Cache-Control", "no-store")
+
+	tokenRes := Oauth2TokenResponse{
+		AccessToken:  accessToken,
+		ExpiresIn:    3600,
+		IdToken:      string(signed),
+		TokenType:    "bearer",
+		RefreshToken: newRefreshToken,
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(tokenRes)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/lastlogin-net/obligator/cookie"
+)
+
+const sessionCookieName = "obligator_session"
+
+// defaultSessionCookieExpire is used whenever FileStorage has no configured
+// cookie_expire override.
+const defaultSessionCookieExpire = 7 * 24 * time.Hour
+
+// sessionCookieExpire returns the configured obligator_session lifetime,
+// falling back to defaultSessionCookieExpire.
+func sessionCookieExpire(storage *FileStorage) time.Duration {
+	expire := storage.GetCookieExpire()
+	if expire <= 0 {
+		return defaultSessionCookieExpire
+	}
+	return expire
+}
+
+// SessionState is the payload carried inside the signed, encrypted
+// obligator_session cookie.
+type SessionState struct {
+	IdentityIds []string  `json:"identity_ids"`
+	LoginKey    string    `json:"login_key"`
+	IssuedAt    time.Time `json:"issued_at"`
+}
+
+// setSessionCookie encrypts and signs state with cookieSecret and sets it
+// as the obligator_session cookie.
+func setSessionCookie(w http.ResponseWriter, storage *FileStorage, cookieSecret []byte, loginKey string, identityIds []string) error {
+	state := &SessionState{
+		IdentityIds: identityIds,
+		LoginKey:    loginKey,
+		IssuedAt:    time.Now().UTC(),
+	}
+
+	payload, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	value, err := cookie.SignedValue(cookieSecret, sessionCookieName, string(payload), time.Now())
+	if err != nil {
+		return err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    value,
+		Secure:   true,
+		HttpOnly: true,
+		MaxAge:   int(sessionCookieExpire(storage).Seconds()),
+		Path:     "/",
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	return nil
+}
+
+// readSessionCookie validates and decodes the obligator_session cookie off
+// r, returning ok=false if it's missing, tampered, or expired.
+func readSessionCookie(r *http.Request, storage *FileStorage, cookieSecret []byte) (*SessionState, bool) {
+	c, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return nil, false
+	}
+
+	payload, ok := cookie.Validate(sessionCookieName, c.Value, cookieSecret, sessionCookieExpire(storage))
+	if !ok {
+		return nil, false
+	}
+
+	state := &SessionState{}
+	err = json.Unmarshal([]byte(payload), state)
+	if err != nil {
+		return nil, false
+	}
+
+	return state, true
+}
+
+// clearSessionCookie removes the obligator_session cookie, mirroring how
+// the login_key cookie is cleared on logout.
+func clearSessionCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    "",
+		Secure:   true,
+		HttpOnly: true,
+		MaxAge:   -1,
+		Path:     "/",
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// identitiesFromIds resolves a list of identity IDs (as cached in a
+// SessionState) back into full Identity records.
+func identitiesFromIds(storage *FileStorage, ids []string) []*Identity {
+	identities := []*Identity{}
+	for _, id := range ids {
+		ident, err := storage.GetIdentityById(id)
+		if err != nil {
+			continue
+		}
+		identities = append(identities, ident)
+	}
+	return identities
+}
@@ -0,0 +1,465 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// WebAuthnCredential is a single registered passkey, keyed by its
+// (base64url-encoded) credential ID.
+type WebAuthnCredential struct {
+	IdentityId   string   `json:"identity_id"`
+	CredentialId string   `json:"credential_id"`
+	PublicKey    []byte   `json:"public_key"`
+	SignCount    uint32   `json:"sign_count"`
+	AAGUID       []byte   `json:"aaguid"`
+	Transports   []string `json:"transports"`
+}
+
+// webauthnUser adapts an Identity and its WebAuthnCredentials to the
+// github.com/go-webauthn/webauthn webauthn.User interface.
+type webauthnUser struct {
+	identity    *Identity
+	credentials []*WebAuthnCredential
+}
+
+func (u *webauthnUser) WebAuthnID() []byte          { return []byte(u.identity.Id) }
+func (u *webauthnUser) WebAuthnName() string        { return u.identity.Email }
+func (u *webauthnUser) WebAuthnDisplayName() string { return u.identity.Email }
+func (u *webauthnUser) WebAuthnIcon() string        { return "" }
+
+func (u *webauthnUser) WebAuthnCredentials() []webauthn.Credential {
+	creds := make([]webauthn.Credential, 0, len(u.credentials))
+	for _, c := range u.credentials {
+		id, err := base64.RawURLEncoding.DecodeString(c.CredentialId)
+		if err != nil {
+			continue
+		}
+		creds = append(creds, webauthn.Credential{
+			ID:        id,
+			PublicKey: c.PublicKey,
+			Authenticator: webauthn.Authenticator{
+				AAGUID:    c.AAGUID,
+				SignCount: c.SignCount,
+			},
+		})
+	}
+	return creds
+}
+
+// webauthnSessionTTL bounds how long a ceremony's challenge may sit
+// unredeemed before /webauthn/*/finish refuses it.
+const webauthnSessionTTL = 5 * time.Minute
+
+var webauthnSessions = struct {
+	sync.Mutex
+	byNonce map[string]webauthnSessionEntry
+}{byNonce: map[string]webauthnSessionEntry{}}
+
+type webauthnSessionEntry struct {
+	data      *webauthn.SessionData
+	expiresAt time.Time
+}
+
+func storeWebauthnSession(data *webauthn.SessionData) (string, error) {
+	nonce, err := GenerateRandomToken(16)
+	if err != nil {
+		return "", err
+	}
+
+	webauthnSessions.Lock()
+	defer webauthnSessions.Unlock()
+
+	webauthnSessions.byNonce[nonce] = webauthnSessionEntry{
+		data:      data,
+		expiresAt: time.Now().Add(webauthnSessionTTL),
+	}
+
+	return nonce, nil
+}
+
+// takeWebauthnSession consumes (and removes) the session data for nonce. A
+// nonce can only ever be redeemed once, whether or not it's expired.
+func takeWebauthnSession(nonce string) (*webauthn.SessionData, bool) {
+	webauthnSessions.Lock()
+	defer webauthnSessions.Unlock()
+
+	entry, exists := webauthnSessions.byNonce[nonce]
+	delete(webauthnSessions.byNonce, nonce)
+
+	if !exists || time.Now().After(entry.expiresAt) {
+		return nil, false
+	}
+
+	return entry.data, true
+}
+
+func transportStrings(transports []protocol.AuthenticatorTransport) []string {
+	out := make([]string, len(transports))
+	for i, t := range transports {
+		out[i] = string(t)
+	}
+	return out
+}
+
+// handleWebAuthnRegisterBegin starts enrollment of a new passkey for an
+// identity already linked to the caller's login_key.
+func handleWebAuthnRegisterBegin(w http.ResponseWriter, r *http.Request, storage *FileStorage, webAuthn *webauthn.WebAuthn) {
+	_, identity, ok := authorizedIdentityForRequest(w, r, storage)
+	if !ok {
+		return
+	}
+
+	creds := storage.GetWebAuthnCredentialsByIdentityId(identity.Id)
+	user := &webauthnUser{identity: identity, credentials: creds}
+
+	options, sessionData, err := webAuthn.BeginRegistration(user)
+	if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	nonce, err := storeWebauthnSession(sessionData)
+	if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	json.NewEncoder(w).Encode(struct {
+		Nonce   string                       `json:"nonce"`
+		Options *protocol.CredentialCreation `json:"options"`
+	}{nonce, options})
+}
+
+// handleWebAuthnRegisterFinish validates the attestation produced in
+// response to handleWebAuthnRegisterBegin and stores the new credential.
+func handleWebAuthnRegisterFinish(w http.ResponseWriter, r *http.Request, storage *FileStorage, webAuthn *webauthn.WebAuthn) {
+	_, identity, ok := authorizedIdentityForRequest(w, r, storage)
+	if !ok {
+		return
+	}
+
+	sessionData, ok := takeWebauthnSession(r.URL.Query().Get("nonce"))
+	if !ok {
+		w.WriteHeader(400)
+		io.WriteString(w, "Unknown or expired registration session")
+		return
+	}
+
+	creds := storage.GetWebAuthnCredentialsByIdentityId(identity.Id)
+	user := &webauthnUser{identity: identity, credentials: creds}
+
+	credential, err := webAuthn.FinishRegistration(user, *sessionData, r)
+	if err != nil {
+		w.WriteHeader(400)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	err = storage.AddWebAuthnCredential(&WebAuthnCredential{
+		IdentityId:   identity.Id,
+		CredentialId: base64.RawURLEncoding.EncodeToString(credential.ID),
+		PublicKey:    credential.PublicKey,
+		SignCount:    credential.Authenticator.SignCount,
+		AAGUID:       credential.Authenticator.AAGUID,
+		Transports:   transportStrings(credential.Transport),
+	})
+	if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	w.WriteHeader(204)
+}
+
+// authorizedIdentityForRequest requires the caller to be logged in and the
+// identity_id in the request to already be linked to their login_key.
+func authorizedIdentityForRequest(w http.ResponseWriter, r *http.Request, storage *FileStorage) (string, *Identity, bool) {
+	loginKeyCookie, err := r.Cookie("login_key")
+	if err != nil {
+		w.WriteHeader(401)
+		io.WriteString(w, "Only logged-in users can manage passkeys")
+		return "", nil, false
+	}
+	loginKey := Hash(loginKeyCookie.Value)
+
+	r.ParseForm()
+	identId := r.URL.Query().Get("identity_id")
+	if identId == "" {
+		identId = r.Form.Get("identity_id")
+	}
+
+	identity, err := storage.GetIdentityById(identId)
+	if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return "", nil, false
+	}
+
+	owner := false
+	for _, mapping := range storage.GetLoginMap() {
+		if mapping.LoginKey == loginKey && mapping.IdentityId == identId {
+			owner = true
+			break
+		}
+	}
+	if !owner {
+		w.WriteHeader(403)
+		io.WriteString(w, "You don't have permissions for this identity")
+		return "", nil, false
+	}
+
+	return loginKey, identity, true
+}
+
+// webauthnVerificationTTL bounds how long a second-factor assertion is
+// trusted by /approve before the caller must re-assert.
+const webauthnVerificationTTL = 5 * time.Minute
+
+var recentWebAuthnVerifications = struct {
+	sync.Mutex
+	byKey map[string]time.Time
+}{byKey: map[string]time.Time{}}
+
+func webauthnVerificationKey(loginKey, identityId string) string {
+	return loginKey + "|" + identityId
+}
+
+// recordWebAuthnVerification marks that loginKey just proved possession of
+// identityId's passkey.
+func recordWebAuthnVerification(loginKey, identityId string) {
+	recentWebAuthnVerifications.Lock()
+	defer recentWebAuthnVerifications.Unlock()
+
+	recentWebAuthnVerifications.byKey[webauthnVerificationKey(loginKey, identityId)] = time.Now().Add(webauthnVerificationTTL)
+}
+
+// hasRecentWebAuthnVerification reports whether loginKey passed a WebAuthn
+// assertion for identityId within the last webauthnVerificationTTL.
+func hasRecentWebAuthnVerification(loginKey, identityId string) bool {
+	recentWebAuthnVerifications.Lock()
+	defer recentWebAuthnVerifications.Unlock()
+
+	expiresAt, ok := recentWebAuthnVerifications.byKey[webauthnVerificationKey(loginKey, identityId)]
+	if !ok {
+		return false
+	}
+	if time.Now().After(expiresAt) {
+		delete(recentWebAuthnVerifications.byKey, webauthnVerificationKey(loginKey, identityId))
+		return false
+	}
+	return true
+}
+
+// requiresWebAuthn reports whether identityId must pass a WebAuthn
+// second-factor assertion before /approve will issue it an authorization
+// code. Having at least one registered passkey is what opts an identity in.
+func requiresWebAuthn(storage *FileStorage, identityId string) bool {
+	return len(storage.GetWebAuthnCredentialsByIdentityId(identityId)) > 0
+}
+
+// handleWebAuthnVerifyBegin starts the second-factor WebAuthn ceremony
+// /approve requires for an identity that has a passkey enrolled. Unlike
+// handleWebAuthnLoginBegin, this is a step-up check, not a primary login.
+func handleWebAuthnVerifyBegin(w http.ResponseWriter, r *http.Request, storage *FileStorage, webAuthn *webauthn.WebAuthn) {
+	_, identity, ok := authorizedIdentityForRequest(w, r, storage)
+	if !ok {
+		return
+	}
+
+	creds := storage.GetWebAuthnCredentialsByIdentityId(identity.Id)
+	if len(creds) == 0 {
+		w.WriteHeader(400)
+		io.WriteString(w, "No passkeys registered for this identity")
+		return
+	}
+
+	user := &webauthnUser{identity: identity, credentials: creds}
+
+	options, sessionData, err := webAuthn.BeginLogin(user)
+	if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	nonce, err := storeWebauthnSession(sessionData)
+	if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	json.NewEncoder(w).Encode(struct {
+		Nonce   string                        `json:"nonce"`
+		Options *protocol.CredentialAssertion `json:"options"`
+	}{nonce, options})
+}
+
+// handleWebAuthnVerifyFinish validates the assertion produced in response
+// to handleWebAuthnVerifyBegin and records a second-factor pass for
+// /approve.
+func handleWebAuthnVerifyFinish(w http.ResponseWriter, r *http.Request, storage *FileStorage, webAuthn *webauthn.WebAuthn) {
+	loginKey, identity, ok := authorizedIdentityForRequest(w, r, storage)
+	if !ok {
+		return
+	}
+
+	sessionData, ok := takeWebauthnSession(r.URL.Query().Get("nonce"))
+	if !ok {
+		w.WriteHeader(400)
+		io.WriteString(w, "Unknown or expired verification session")
+		return
+	}
+
+	creds := storage.GetWebAuthnCredentialsByIdentityId(identity.Id)
+	user := &webauthnUser{identity: identity, credentials: creds}
+
+	credential, err := webAuthn.FinishLogin(user, *sessionData, r)
+	if err != nil {
+		w.WriteHeader(401)
+		io.WriteString(w, "Passkey assertion failed")
+		return
+	}
+
+	err = storage.UpdateWebAuthnCredentialSignCount(
+		base64.RawURLEncoding.EncodeToString(credential.ID),
+		credential.Authenticator.SignCount,
+	)
+	if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	recordWebAuthnVerification(loginKey, identity.Id)
+
+	w.WriteHeader(204)
+}
+
+// handleWebAuthnLoginBegin starts a passkey login ceremony for the
+// identity owning email, a primary-factor alternative to the email-code
+// flow.
+func handleWebAuthnLoginBegin(w http.ResponseWriter, r *http.Request, storage *FileStorage, webAuthn *webauthn.WebAuthn) {
+	r.ParseForm()
+
+	identity, err := storage.GetIdentityByEmail(r.Form.Get("email"))
+	if err != nil {
+		w.WriteHeader(400)
+		io.WriteString(w, "No such identity")
+		return
+	}
+
+	creds := storage.GetWebAuthnCredentialsByIdentityId(identity.Id)
+	if len(creds) == 0 {
+		w.WriteHeader(400)
+		io.WriteString(w, "No passkeys registered for this identity")
+		return
+	}
+
+	user := &webauthnUser{identity: identity, credentials: creds}
+
+	options, sessionData, err := webAuthn.BeginLogin(user)
+	if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	nonce, err := storeWebauthnSession(sessionData)
+	if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	json.NewEncoder(w).Encode(struct {
+		Nonce   string                        `json:"nonce"`
+		Options *protocol.CredentialAssertion `json:"options"`
+	}{nonce, options})
+}
+
+// handleWebAuthnLoginFinish validates the assertion produced in response to
+// handleWebAuthnLoginBegin and, on success, logs the caller in the same way
+// /complete-email-login does.
+func handleWebAuthnLoginFinish(w http.ResponseWriter, r *http.Request, storage *FileStorage, webAuthn *webauthn.WebAuthn, rootUri string, cookieSecret []byte) {
+	r.ParseForm()
+
+	sessionData, ok := takeWebauthnSession(r.URL.Query().Get("nonce"))
+	if !ok {
+		w.WriteHeader(400)
+		io.WriteString(w, "Unknown or expired login session")
+		return
+	}
+
+	requestId := r.Form.Get("request_id")
+
+	request, err := storage.GetRequest(requestId)
+	if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	identity, err := storage.GetIdentityByEmail(r.Form.Get("email"))
+	if err != nil {
+		w.WriteHeader(400)
+		io.WriteString(w, "No such identity")
+		return
+	}
+
+	creds := storage.GetWebAuthnCredentialsByIdentityId(identity.Id)
+	user := &webauthnUser{identity: identity, credentials: creds}
+
+	credential, err := webAuthn.FinishLogin(user, *sessionData, r)
+	if err != nil {
+		w.WriteHeader(401)
+		io.WriteString(w, "Passkey assertion failed")
+		return
+	}
+
+	err = storage.UpdateWebAuthnCredentialSignCount(
+		base64.RawURLEncoding.EncodeToString(credential.ID),
+		credential.Authenticator.SignCount,
+	)
+	if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	loginKey, err := ensureLoginKey(w, r, storage)
+	if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	storage.EnsureLoginMapping(identity.Id, loginKey)
+	recordWebAuthnVerification(loginKey, identity.Id)
+
+	err = refreshSessionCookie(w, storage, cookieSecret, loginKey)
+	if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	redirUrl := fmt.Sprintf("%s/auth?%s", rootUri, request.RawQuery)
+
+	http.Redirect(w, r, redirUrl, http.StatusSeeOther)
+}